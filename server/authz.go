@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+
+	test2pb "github.com/google/cel-spec/proto/test/v1/proto2/test_all_types"
+	test3pb "github.com/google/cel-spec/proto/test/v1/proto3/test_all_types"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// AuthorizationArgs mirrors the request/connection attributes gRPC's
+// authorization engine feeds to CEL (request.*, source.*, destination.*).
+//
+// NOTE: a real wire representation of this message would live in the
+// conformance proto package (confpb) as a typed protobuf so that an
+// EvalRequest extension or EvalAuthz RPC could carry it across the wire.
+// That package is generated from google/cel-spec and isn't regenerable in
+// this tree, so AuthorizationArgs is a plain Go struct for now; once the
+// proto field/RPC lands, this type's fields should mirror it one-for-one.
+type AuthorizationArgs struct {
+	Request     map[string]interface{}
+	Source      map[string]interface{}
+	Destination map[string]interface{}
+}
+
+// authzDeclarations declares the request.*, source.*, and destination.*
+// variables available to an authorization-style CEL expression.
+func authzDeclarations() cel.EnvOption {
+	return cel.Declarations(
+		decls.NewVar("request", decls.NewMapType(decls.String, decls.Dyn)),
+		decls.NewVar("source", decls.NewMapType(decls.String, decls.Dyn)),
+		decls.NewVar("destination", decls.NewMapType(decls.String, decls.Dyn)),
+	)
+}
+
+// AuthzActivation exposes an AuthorizationArgs value as CEL variables under
+// the request, source, and destination namespaces. It implements
+// interpreter.Activation.
+type AuthzActivation struct {
+	adapter ref.TypeAdapter
+	args    *AuthorizationArgs
+}
+
+// NewAuthzActivation returns an Activation which resolves request.*,
+// source.*, and destination.* against args.
+func NewAuthzActivation(adapter ref.TypeAdapter, args *AuthorizationArgs) *AuthzActivation {
+	return &AuthzActivation{adapter: adapter, args: args}
+}
+
+// ResolveName implements interpreter.Activation.
+func (a *AuthzActivation) ResolveName(name string) (interface{}, bool) {
+	var attrs map[string]interface{}
+	switch name {
+	case "request":
+		attrs = a.args.Request
+	case "source":
+		attrs = a.args.Source
+	case "destination":
+		attrs = a.args.Destination
+	default:
+		return nil, false
+	}
+	if attrs == nil {
+		return nil, false
+	}
+	return a.adapter.NativeToValue(attrs), true
+}
+
+// Parent implements interpreter.Activation.
+func (a *AuthzActivation) Parent() interpreter.Activation {
+	return nil
+}
+
+// NewAuthzEnv builds the cel.Env used to compile and evaluate
+// authorization-style expressions against request/source/destination
+// attributes.
+func NewAuthzEnv(opts ...cel.EnvOption) (*cel.Env, error) {
+	envOpts := append([]cel.EnvOption{authzDeclarations()}, opts...)
+	return cel.NewEnv(envOpts...)
+}
+
+// CompileString parses and checks src against env in one call, returning a
+// cel.Program ready to Eval. It mirrors the single-call compile helper from
+// gRPC's authorization engine integration.
+func CompileString(env *cel.Env, src string) (cel.Program, error) {
+	ast, iss := env.Parse(src)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	checked, iss := env.Check(ast)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	return env.Program(checked)
+}
+
+// EvalAuthz evaluates src against env under the attributes carried by args.
+func EvalAuthz(env *cel.Env, src string, args *AuthorizationArgs) (ref.Val, error) {
+	prg, err := CompileString(env, src)
+	if err != nil {
+		return nil, err
+	}
+	act := NewAuthzActivation(env.TypeAdapter(), args)
+	res, _, err := prg.Eval(act)
+	return res, err
+}
+
+// EvalAuthz is the Go-level equivalent of the EvalRequest extension / wrapper
+// RPC described in the backlog request: it evaluates src against an
+// environment built by NewAuthzEnv, with request/source/destination bound
+// from args instead of from in.Bindings. Exposing this over gRPC still
+// needs either a new field on EvalRequest or a new EvalAuthz RPC, both of
+// which require a conformance .proto change this tree can't regenerate; in
+// the meantime this method is how a caller within the server process uses
+// the authz environment today.
+func (s *ConformanceServer) EvalAuthz(ctx context.Context, container string, src string, args *AuthorizationArgs) (*exprpb.ExprValue, error) {
+	env, err := NewAuthzEnv(cel.Container(container),
+		cel.Types(&test2pb.TestAllTypes{}, &test3pb.TestAllTypes{}))
+	if err != nil {
+		return nil, err
+	}
+	res, err := EvalAuthz(env, src, args)
+	return RefValueToExprValue(res, err)
+}
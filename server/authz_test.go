@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+func TestAuthzActivationResolveName(t *testing.T) {
+	args := &AuthorizationArgs{
+		Request: map[string]interface{}{"path": "/v1/get"},
+	}
+	act := NewAuthzActivation(types.DefaultTypeAdapter, args)
+
+	val, found := act.ResolveName("request")
+	if !found {
+		t.Fatalf("ResolveName(%q) not found", "request")
+	}
+	m := val.(ref.Val).(traits.Indexer)
+	if got := m.Get(types.String("path")); got.Equal(types.String("/v1/get")) != types.True {
+		t.Errorf("request.path = %v, want /v1/get", got)
+	}
+
+	if _, found := act.ResolveName("source"); found {
+		t.Errorf("ResolveName(%q) found, want not found for a nil Source map", "source")
+	}
+	if _, found := act.ResolveName("unknown"); found {
+		t.Errorf("ResolveName(%q) found, want not found", "unknown")
+	}
+}
+
+func TestEvalAuthz(t *testing.T) {
+	env, err := NewAuthzEnv()
+	if err != nil {
+		t.Fatalf("NewAuthzEnv() failed: %v", err)
+	}
+	args := &AuthorizationArgs{
+		Request: map[string]interface{}{"path": "/v1/get"},
+	}
+	res, err := EvalAuthz(env, `request.path == "/v1/get"`, args)
+	if err != nil {
+		t.Fatalf("EvalAuthz() failed: %v", err)
+	}
+	if res != types.True {
+		t.Errorf("EvalAuthz() = %v, want true", res)
+	}
+}
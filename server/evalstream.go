@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+
+	confpb "google.golang.org/genproto/googleapis/api/expr/conformance/v1alpha1"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// EvalStreamOptions selects which cel.EvalOptions are enabled for a streamed
+// evaluation. It stands in for a request field on a streaming Eval RPC; see
+// the doc comment on EvalTracked for why that RPC isn't wired up in this
+// package.
+type EvalStreamOptions struct {
+	// Track records the ref.Val produced at every sub-expression ID.
+	Track bool
+	// Partial enables cel.OptPartialEval. An unknown result is returned as
+	// an UnknownSet ExprValue; no residual expression is built.
+	Partial bool
+	// Exhaustive disables short-circuiting so every sub-expression, even
+	// ones an earlier branch would normally skip, is evaluated and
+	// recorded.
+	Exhaustive bool
+}
+
+// evalOptions returns the cel.EvalOptions implied by o.
+func (o EvalStreamOptions) evalOptions() cel.EvalOption {
+	var opts cel.EvalOption
+	if o.Track {
+		opts |= cel.OptTrackState
+	}
+	if o.Partial {
+		opts |= cel.OptPartialEval
+	}
+	if o.Exhaustive {
+		opts |= cel.OptExhaustiveEval
+	}
+	return opts
+}
+
+// EvalTracked evaluates ast against env with the given options and returns
+// both the final result and a per-expr-ID trace of every intermediate value
+// recorded in the program's EvalState, converted to ExprValue the same way
+// the final result is.
+//
+// This is the reusable core of a debugger-style streaming Eval RPC: see
+// (*ConformanceServer).EvalStream below, which calls it with the same
+// env/ast/args a plain Eval would use. A real RPC handler would send one
+// message per entry of the returned trace, followed by a final message for
+// the result, but that requires a new method on the generated
+// ConformanceService interface and a ConformanceService_EvalStreamServer
+// stream type, both of which come from the conformance .proto in
+// google/cel-spec; that proto isn't present in this tree to regenerate, so
+// EvalStream is a plain Go method rather than a gRPC handler for now.
+func EvalTracked(env *cel.Env, ast *cel.Ast, args map[string]interface{}, opts EvalStreamOptions) (result *exprpb.ExprValue, trace map[int64]*exprpb.ExprValue, err error) {
+	prg, err := env.Program(ast, cel.EvalOptions(opts.evalOptions()))
+	if err != nil {
+		return nil, nil, err
+	}
+	res, det, err := prg.Eval(args)
+	// An error result is also returned as err; convert it from res so that
+	// an encoded error set is decoded, as Eval does.
+	if types.IsError(res) {
+		err = nil
+	}
+	result, err = RefValueToExprValue(res, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	var state interpreter.EvalState
+	if det != nil {
+		state = det.State()
+	}
+	trace, err = evalStateToExprValues(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, trace, nil
+}
+
+// evalStateToExprValues walks every expr ID recorded in state and converts
+// its ref.Val to an ExprValue, the same conversion used for the final Eval
+// result.
+func evalStateToExprValues(state interpreter.EvalState) (map[int64]*exprpb.ExprValue, error) {
+	if state == nil {
+		return nil, nil
+	}
+	trace := make(map[int64]*exprpb.ExprValue, len(state.IDs()))
+	for _, id := range state.IDs() {
+		val, found := state.Value(id)
+		if !found {
+			continue
+		}
+		ev, err := RefValueToExprValue(val, nil)
+		if err != nil {
+			return nil, err
+		}
+		trace[id] = ev
+	}
+	return trace, nil
+}
+
+// EvalStream is the Go-level equivalent of the streaming Eval RPC described
+// above: it builds the same environment, AST, and bindings Eval would, then
+// hands them to EvalTracked instead of discarding the EvalState. Once a
+// real EvalStream RPC exists, its handler can call this method once per
+// request and stream result/trace straight through.
+func (s *ConformanceServer) EvalStream(ctx context.Context, in *confpb.EvalRequest, opts EvalStreamOptions) (result *exprpb.ExprValue, trace map[int64]*exprpb.ExprValue, err error) {
+	env, ast, args, err := s.prepareEval(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	return EvalTracked(env, ast, args, opts)
+}
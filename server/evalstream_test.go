@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+func TestEvalTracked(t *testing.T) {
+	env, err := cel.NewEnv(cel.Declarations(decls.NewVar("x", decls.Int)))
+	if err != nil {
+		t.Fatalf("cel.NewEnv() failed: %v", err)
+	}
+	parsed, iss := env.Parse("x + 1")
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Parse() failed: %v", iss.Err())
+	}
+	checked, iss := env.Check(parsed)
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Check() failed: %v", iss.Err())
+	}
+	result, trace, err := EvalTracked(env, checked, map[string]interface{}{"x": int64(1)}, EvalStreamOptions{Track: true})
+	if err != nil {
+		t.Fatalf("EvalTracked() failed: %v", err)
+	}
+	got := result.GetValue().GetInt64Value()
+	if got != 2 {
+		t.Errorf("EvalTracked() result = %v, want 2", got)
+	}
+	if len(trace) == 0 {
+		t.Errorf("EvalTracked() trace is empty, want an entry per tracked sub-expression")
+	}
+}
+
+func TestEvalTrackedWithoutTracking(t *testing.T) {
+	env, err := cel.NewEnv()
+	if err != nil {
+		t.Fatalf("cel.NewEnv() failed: %v", err)
+	}
+	parsed, iss := env.Parse("1 + 1")
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Parse() failed: %v", iss.Err())
+	}
+	checked, iss := env.Check(parsed)
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Check() failed: %v", iss.Err())
+	}
+	_, trace, err := EvalTracked(env, checked, map[string]interface{}{}, EvalStreamOptions{})
+	if err != nil {
+		t.Fatalf("EvalTracked() failed: %v", err)
+	}
+	if len(trace) != 0 {
+		t.Errorf("EvalTracked() trace = %v, want empty when Track is false", trace)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/parser"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// registerDecls turns a list of function/variable declarations into the
+// cel.EnvOption that installs them, so a single request-scoped list of
+// exprpb.Decl can be layered onto the environment built for that call.
+func registerDecls(decls []*exprpb.Decl) cel.EnvOption {
+	return cel.Declarations(decls...)
+}
+
+// MacroSpec describes a request-scoped macro: a name, the argument count it
+// expands at (parser.Macro requires a fixed arity), whether it's invoked as
+// a receiver call (`target.name(args)`) or a global call (`name(args)`),
+// and a template AST whose free variables `target` and `arg0..argN-1` are
+// substituted with the actual call site's target and arguments.
+//
+// NOTE: for a MacroSpec to travel with a Parse/Check/Eval request it needs
+// a field on the corresponding request messages in the conformance proto
+// (google/cel-spec), which isn't present in this tree to regenerate. The
+// translation to a parser.Macro below is the reusable part of that wiring.
+type MacroSpec struct {
+	Name          string
+	ReceiverStyle bool
+	ArgCount      int
+	Template      *exprpb.ParsedExpr
+}
+
+// macroSpecToMacro builds a parser.Macro that expands a call matching spec
+// by substituting the call's target and arguments into spec.Template.
+func macroSpecToMacro(spec MacroSpec) parser.Macro {
+	expander := func(eh parser.ExprHelper, target *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+		bindings := make(map[string]*exprpb.Expr, len(args)+1)
+		if target != nil {
+			bindings["target"] = target
+		}
+		for i, arg := range args {
+			bindings[argPlaceholder(i)] = arg
+		}
+		return substituteTemplate(eh, spec.Template.GetExpr(), bindings), nil
+	}
+	if spec.ReceiverStyle {
+		return parser.NewReceiverMacro(spec.Name, spec.ArgCount, expander)
+	}
+	return parser.NewGlobalMacro(spec.Name, spec.ArgCount, expander)
+}
+
+// argPlaceholder names the substitution variable for the i'th macro
+// argument in a MacroSpec template, e.g. "arg0", "arg1", "arg10".
+func argPlaceholder(i int) string {
+	return "arg" + strconv.Itoa(i)
+}
+
+// substituteTemplate walks tmpl and replaces any identifier expression whose
+// name matches a key in bindings with the corresponding bound expression,
+// re-minting IDs through eh so the expanded AST doesn't collide with the
+// rest of the expression being parsed.
+//
+// Every node kind is rebuilt through eh, even ones with nothing to
+// substitute (e.g. a Const nested under a List), so that a second expansion
+// of the same MacroSpec in one expression doesn't reuse the first
+// expansion's IDs. A literal kind eh has no constructor for (e.g. a null
+// Constant) is returned unminted, so invoking such a macro more than once
+// in a single expression can still produce duplicate IDs for that subtree.
+// Bound target and argument expressions are inserted as they are, so a
+// template that names the same placeholder more than once repeats that
+// expression's IDs.
+func substituteTemplate(eh parser.ExprHelper, tmpl *exprpb.Expr, bindings map[string]*exprpb.Expr) *exprpb.Expr {
+	if tmpl == nil {
+		return nil
+	}
+	if ident := tmpl.GetIdentExpr(); ident != nil {
+		if bound, ok := bindings[ident.Name]; ok {
+			return bound
+		}
+		return eh.Ident(ident.Name)
+	}
+	if call := tmpl.GetCallExpr(); call != nil {
+		var target *exprpb.Expr
+		if call.Target != nil {
+			target = substituteTemplate(eh, call.Target, bindings)
+		}
+		args := make([]*exprpb.Expr, len(call.Args))
+		for i, a := range call.Args {
+			args[i] = substituteTemplate(eh, a, bindings)
+		}
+		if target != nil {
+			return eh.ReceiverCall(call.Function, target, args...)
+		}
+		return eh.GlobalCall(call.Function, args...)
+	}
+	if list := tmpl.GetListExpr(); list != nil {
+		elems := make([]*exprpb.Expr, len(list.Elements))
+		for i, e := range list.Elements {
+			elems[i] = substituteTemplate(eh, e, bindings)
+		}
+		return eh.NewList(elems...)
+	}
+	if sel := tmpl.GetSelectExpr(); sel != nil {
+		operand := substituteTemplate(eh, sel.Operand, bindings)
+		if sel.TestOnly {
+			return eh.PresenceTest(operand, sel.Field)
+		}
+		return eh.Select(operand, sel.Field)
+	}
+	if str := tmpl.GetStructExpr(); str != nil {
+		entries := make([]*exprpb.Expr_CreateStruct_Entry, len(str.Entries))
+		for i, entry := range str.Entries {
+			val := substituteTemplate(eh, entry.Value, bindings)
+			if fieldKey, ok := entry.KeyKind.(*exprpb.Expr_CreateStruct_Entry_FieldKey); ok {
+				entries[i] = eh.NewObjectFieldInit(fieldKey.FieldKey, val, entry.OptionalEntry)
+			} else {
+				key := substituteTemplate(eh, entry.GetMapKey(), bindings)
+				entries[i] = eh.NewMapEntry(key, val, entry.OptionalEntry)
+			}
+		}
+		if str.MessageName != "" {
+			return eh.NewObject(str.MessageName, entries...)
+		}
+		return eh.NewMap(entries...)
+	}
+	if comp := tmpl.GetComprehensionExpr(); comp != nil {
+		return eh.Fold(
+			comp.IterVar,
+			substituteTemplate(eh, comp.IterRange, bindings),
+			comp.AccuVar,
+			substituteTemplate(eh, comp.AccuInit, bindings),
+			substituteTemplate(eh, comp.LoopCondition, bindings),
+			substituteTemplate(eh, comp.LoopStep, bindings),
+			substituteTemplate(eh, comp.Result, bindings),
+		)
+	}
+	if c := tmpl.GetConstExpr(); c != nil {
+		switch k := c.ConstantKind.(type) {
+		case *exprpb.Constant_BoolValue:
+			return eh.LiteralBool(k.BoolValue)
+		case *exprpb.Constant_BytesValue:
+			return eh.LiteralBytes(k.BytesValue)
+		case *exprpb.Constant_DoubleValue:
+			return eh.LiteralDouble(k.DoubleValue)
+		case *exprpb.Constant_Int64Value:
+			return eh.LiteralInt(k.Int64Value)
+		case *exprpb.Constant_StringValue:
+			return eh.LiteralString(k.StringValue)
+		case *exprpb.Constant_Uint64Value:
+			return eh.LiteralUint(k.Uint64Value)
+		}
+	}
+	// Anything else (a null Constant, or a future Expr kind) has no
+	// re-minting constructor on parser.ExprHelper: return it unminted
+	// rather than silently producing a malformed AST.
+	return tmpl
+}
+
+// ParseWithExtensions is the Go-level equivalent of Parse extended to carry
+// per-request custom declarations and macros: it builds the environment
+// Parse would, layered with registerDecls(decls) and the macros
+// macroSpecToMacro translates specs into, then parses src through it.
+// Exposing this over gRPC still needs a new field on ParseRequest (and
+// probably CheckRequest/EvalRequest, to typecheck and evaluate against the
+// same declarations), which requires a conformance .proto change this tree
+// can't regenerate; in the meantime this method is how a caller within the
+// server process uses request-scoped declarations and macros today.
+func (s *ConformanceServer) ParseWithExtensions(ctx context.Context, src string, decls []*exprpb.Decl, macros []MacroSpec) (*exprpb.ParsedExpr, error) {
+	macroOpts := make([]parser.Macro, len(macros))
+	for i, spec := range macros {
+		macroOpts[i] = macroSpecToMacro(spec)
+	}
+	env, err := cel.NewEnv(registerDecls(decls), cel.Macros(macroOpts...))
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Parse(src)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	return cel.AstToParsedExpr(ast)
+}
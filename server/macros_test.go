@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func TestArgPlaceholder(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "arg0"},
+		{9, "arg9"},
+		{10, "arg10"},
+		{23, "arg23"},
+	}
+	for _, tc := range tests {
+		if got := argPlaceholder(tc.i); got != tc.want {
+			t.Errorf("argPlaceholder(%d) = %q, want %q", tc.i, got, tc.want)
+		}
+	}
+}
+
+// getXSpec is a receiver-style MacroSpec expanding `target.getX()` to
+// `target.x`, a Select whose operand is the bound "target" identifier. It
+// exercises the GetSelectExpr branch of substituteTemplate added in the
+// fix for duplicate-ID/missed-substitution bugs under Select targets.
+var getXSpec = MacroSpec{
+	Name:          "getX",
+	ReceiverStyle: true,
+	ArgCount:      0,
+	Template: &exprpb.ParsedExpr{
+		Expr: &exprpb.Expr{
+			Id: 1,
+			ExprKind: &exprpb.Expr_SelectExpr{
+				SelectExpr: &exprpb.Expr_Select{
+					Operand: &exprpb.Expr{
+						Id:       2,
+						ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: "target"}},
+					},
+					Field: "x",
+				},
+			},
+		},
+	},
+}
+
+func TestMacroSpecToMacroSubstitutesUnderSelect(t *testing.T) {
+	env, err := cel.NewEnv(cel.Macros(macroSpecToMacro(getXSpec)))
+	if err != nil {
+		t.Fatalf("cel.NewEnv() failed: %v", err)
+	}
+	ast, iss := env.Parse("a.getX()")
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Parse() failed: %v", iss.Err())
+	}
+	parsedExpr, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		t.Fatalf("cel.AstToParsedExpr() failed: %v", err)
+	}
+	sel := parsedExpr.GetExpr().GetSelectExpr()
+	if sel == nil {
+		t.Fatalf("parsed expr = %v, want a top-level Select", parsedExpr.GetExpr())
+	}
+	if sel.Field != "x" {
+		t.Errorf("sel.Field = %q, want %q", sel.Field, "x")
+	}
+	if ident := sel.Operand.GetIdentExpr(); ident == nil || ident.Name != "a" {
+		t.Errorf("sel.Operand = %v, want ident \"a\" substituted for target", sel.Operand)
+	}
+}
+
+func TestMacroSpecToMacroNoDuplicateIDsOnRepeatedInvocation(t *testing.T) {
+	env, err := cel.NewEnv(cel.Macros(macroSpecToMacro(getXSpec)))
+	if err != nil {
+		t.Fatalf("cel.NewEnv() failed: %v", err)
+	}
+	ast, iss := env.Parse("a.getX() == b.getX()")
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Parse() failed: %v", iss.Err())
+	}
+	parsedExpr, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		t.Fatalf("cel.AstToParsedExpr() failed: %v", err)
+	}
+	seen := make(map[int64]bool)
+	var dupes []int64
+	collectExprIDs(parsedExpr.GetExpr(), seen, &dupes)
+	if len(dupes) != 0 {
+		t.Errorf("duplicate expr IDs across two macro invocations: %v", dupes)
+	}
+	call := parsedExpr.GetExpr().GetCallExpr()
+	if call == nil || len(call.Args) != 2 {
+		t.Fatalf("parsed expr = %v, want a top-level == call", parsedExpr.GetExpr())
+	}
+	for _, side := range call.Args {
+		if sel := side.GetSelectExpr(); sel == nil || sel.Field != "x" {
+			t.Errorf("call arg = %v, want a Select on field \"x\"", side)
+		}
+	}
+}
+
+// collectExprIDs walks e and every sub-expression, recording each id seen
+// in seen and appending to dupes any id seen more than once.
+func collectExprIDs(e *exprpb.Expr, seen map[int64]bool, dupes *[]int64) {
+	if e == nil {
+		return
+	}
+	if seen[e.Id] {
+		*dupes = append(*dupes, e.Id)
+	}
+	seen[e.Id] = true
+	switch kind := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		collectExprIDs(kind.SelectExpr.Operand, seen, dupes)
+	case *exprpb.Expr_CallExpr:
+		collectExprIDs(kind.CallExpr.Target, seen, dupes)
+		for _, a := range kind.CallExpr.Args {
+			collectExprIDs(a, seen, dupes)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, el := range kind.ListExpr.Elements {
+			collectExprIDs(el, seen, dupes)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range kind.StructExpr.Entries {
+			if mk := entry.GetMapKey(); mk != nil {
+				collectExprIDs(mk, seen, dupes)
+			}
+			collectExprIDs(entry.Value, seen, dupes)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		c := kind.ComprehensionExpr
+		collectExprIDs(c.IterRange, seen, dupes)
+		collectExprIDs(c.AccuInit, seen, dupes)
+		collectExprIDs(c.LoopCondition, seen, dupes)
+		collectExprIDs(c.LoopStep, seen, dupes)
+		collectExprIDs(c.Result, seen, dupes)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/common/types"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	rpcpb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestErrorSetRoundTrip(t *testing.T) {
+	want := &exprpb.ExprValue{
+		Kind: &exprpb.ExprValue_Error{
+			Error: &exprpb.ErrorSet{
+				Errors: []*rpcpb.Status{
+					{Code: 3, Message: "bad argument"},
+					{Code: 5, Message: "not found"},
+				},
+			},
+		},
+	}
+	refVal, err := ExprValueToRefValue(types.DefaultTypeAdapter, want)
+	if err != nil {
+		t.Fatalf("ExprValueToRefValue() failed: %v", err)
+	}
+	got, err := RefValueToExprValue(refVal, nil)
+	if err != nil {
+		t.Fatalf("RefValueToExprValue() failed: %v", err)
+	}
+	gotErrs := got.GetError().GetErrors()
+	wantErrs := want.GetError().GetErrors()
+	if len(gotErrs) != len(wantErrs) {
+		t.Fatalf("round trip errors = %v, want %v", gotErrs, wantErrs)
+	}
+	for i, e := range wantErrs {
+		if gotErrs[i].GetCode() != e.GetCode() || gotErrs[i].GetMessage() != e.GetMessage() {
+			t.Errorf("round trip error[%d] = %+v, want %+v", i, gotErrs[i], e)
+		}
+	}
+}
+
+func TestUnknownRoundTrip(t *testing.T) {
+	want := &exprpb.ExprValue{
+		Kind: &exprpb.ExprValue_Unknown{
+			Unknown: &exprpb.UnknownSet{Exprs: []int64{1, 2, 3}},
+		},
+	}
+	refVal, err := ExprValueToRefValue(types.DefaultTypeAdapter, want)
+	if err != nil {
+		t.Fatalf("ExprValueToRefValue() failed: %v", err)
+	}
+	got, err := RefValueToExprValue(refVal, nil)
+	if err != nil {
+		t.Fatalf("RefValueToExprValue() failed: %v", err)
+	}
+	gotExprs := got.GetUnknown().GetExprs()
+	wantExprs := want.GetUnknown().GetExprs()
+	if len(gotExprs) != len(wantExprs) {
+		t.Fatalf("round trip exprs = %v, want %v", gotExprs, wantExprs)
+	}
+	for i, id := range wantExprs {
+		if gotExprs[i] != id {
+			t.Errorf("round trip expr[%d] = %d, want %d", i, gotExprs[i], id)
+		}
+	}
+}
+
+func TestErrorSetDecodeFallsThroughForOrdinaryError(t *testing.T) {
+	// A types.Err not produced by encodeErrorSet should round-trip as a
+	// single generic error, not be mistaken for an encoded error set.
+	got, err := RefValueToExprValue(types.NewErr("boom"), nil)
+	if err != nil {
+		t.Fatalf("RefValueToExprValue() failed: %v", err)
+	}
+	errs := got.GetError().GetErrors()
+	if len(errs) != 1 {
+		t.Fatalf("errors = %v, want exactly one generic error", errs)
+	}
+	if errs[0].GetMessage() != "boom" {
+		t.Errorf("errors[0].Message = %q, want %q", errs[0].GetMessage(), "boom")
+	}
+}
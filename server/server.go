@@ -17,7 +17,10 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common"
@@ -30,9 +33,15 @@ import (
 	test3pb "github.com/google/cel-spec/proto/test/v1/proto3/test_all_types"
 	confpb "google.golang.org/genproto/googleapis/api/expr/conformance/v1alpha1"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	errdetailspb "google.golang.org/genproto/googleapis/rpc/errdetails"
 	rpcpb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
+// errorSetPrefix marks a types.Err message produced from an ExprValue_Error
+// binding, so that RefValueToExprValue can recover the original rpcpb.Status
+// list instead of emitting a generic error.
+const errorSetPrefix = "cel-conformance-error-set:"
+
 // ConformanceServer contains the server state.
 type ConformanceServer struct{}
 
@@ -54,8 +63,9 @@ func (s *ConformanceServer) Parse(ctx context.Context, in *confpb.ParseRequest)
 		// Success
 		resp.ParsedExpr, _ = cel.AstToParsedExpr(past)
 	} else {
-		// Failure
-		appendErrors(iss.Errors(), &resp.Issues)
+		// Failure. No SourceInfo exists yet to correlate an error back to an
+		// expr ID: parsing is what produces that tree, and it just failed.
+		appendErrors(iss.Errors(), nil, &resp.Issues)
 	}
 	return &resp, nil
 }
@@ -88,63 +98,89 @@ func (s *ConformanceServer) Check(ctx context.Context, in *confpb.CheckRequest)
 		// Success
 		resp.CheckedExpr, _ = cel.AstToCheckedExpr(cast)
 	} else {
-		// Failure
-		appendErrors(iss.Errors(), &resp.Issues)
+		// Failure. Unlike Parse, in.ParsedExpr.Expr already has real expr
+		// IDs with known source positions, so checker errors can be
+		// correlated back to the node that produced them.
+		appendErrors(iss.Errors(), in.ParsedExpr.SourceInfo, &resp.Issues)
 	}
 	return &resp, nil
 }
 
 // Eval implements ConformanceService.Eval.
 func (s *ConformanceServer) Eval(ctx context.Context, in *confpb.EvalRequest) (*confpb.EvalResponse, error) {
-	env, _ := cel.NewEnv(cel.Container(in.Container),
+	env, ast, args, err := s.prepareEval(in)
+	if err != nil {
+		return nil, err
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := prg.Eval(args)
+	// An error result is also returned as err; convert it from res so that
+	// an error set bound in the request is decoded rather than reported as
+	// one generic status.
+	if types.IsError(res) {
+		err = nil
+	}
+	resultExprVal, err := RefValueToExprValue(res, err)
+	if err != nil {
+		return nil, fmt.Errorf("con't convert result: %s", err)
+	}
+	return &confpb.EvalResponse{Result: resultExprVal}, nil
+}
+
+// prepareEval builds the environment, program AST, and evaluation bindings
+// described by in. It's the shared first half of Eval and EvalStream.
+func (s *ConformanceServer) prepareEval(in *confpb.EvalRequest) (env *cel.Env, ast *cel.Ast, args map[string]interface{}, err error) {
+	env, _ = cel.NewEnv(cel.Container(in.Container),
 		cel.Types(&test2pb.TestAllTypes{}, &test3pb.TestAllTypes{}))
-	var prg cel.Program
-	var err error
 	switch in.ExprKind.(type) {
 	case *confpb.EvalRequest_ParsedExpr:
-		ast := cel.ParsedExprToAst(in.GetParsedExpr())
-		prg, err = env.Program(ast)
-		if err != nil {
-			return nil, err
-		}
+		ast = cel.ParsedExprToAst(in.GetParsedExpr())
 	case *confpb.EvalRequest_CheckedExpr:
-		ast := cel.CheckedExprToAst(in.GetCheckedExpr())
-		prg, err = env.Program(ast)
-		if err != nil {
-			return nil, err
-		}
+		ast = cel.CheckedExprToAst(in.GetCheckedExpr())
 	default:
 		st := status.New(codes.InvalidArgument, "No expression.")
-		return nil, st.Err()
+		return nil, nil, nil, st.Err()
 	}
-	args := make(map[string]interface{})
+	args = make(map[string]interface{})
 	for name, exprValue := range in.Bindings {
 		refVal, err := ExprValueToRefValue(env.TypeAdapter(), exprValue)
 		if err != nil {
-			return nil, fmt.Errorf("can't convert binding %s: %s", name, err)
+			return nil, nil, nil, fmt.Errorf("can't convert binding %s: %s", name, err)
 		}
 		args[name] = refVal
 	}
-	// NOTE: the EvalState is currently discarded
-	res, _, err := prg.Eval(args)
-	resultExprVal, err := RefValueToExprValue(res, err)
-	if err != nil {
-		return nil, fmt.Errorf("con't convert result: %s", err)
-	}
-	return &confpb.EvalResponse{Result: resultExprVal}, nil
+	return env, ast, args, nil
 }
 
-// appendErrors converts the errors from errs to Status messages
-// and appends them to the list of issues.
-func appendErrors(errs []common.Error, issues *[]*rpcpb.Status) {
+// appendErrors converts the errors from errs to Status messages and appends
+// them to the list of issues. info, if non-nil, is used to correlate each
+// error's source position back to the expr ID of the node that produced it.
+func appendErrors(errs []common.Error, info *exprpb.SourceInfo, issues *[]*rpcpb.Status) {
 	for _, e := range errs {
-		status := ErrToStatus(e, confpb.IssueDetails_ERROR)
+		status := ErrToStatus(e, confpb.IssueDetails_ERROR, info)
 		*issues = append(*issues, status)
 	}
 }
 
-// ErrToStatus converts an Error to a Status message with the given severity.
-func ErrToStatus(e common.Error, severity confpb.IssueDetails_Severity) *rpcpb.Status {
+// ErrToStatus converts an Error to a Status message with the given
+// severity. info, if non-nil, is searched for the expr ID whose source
+// position matches e.Location; when found, it's attached as an
+// errdetails.ErrorInfo detail alongside the existing IssueDetails.
+//
+// NOTE: the precise fix for issue correlation is a new Id field on
+// common.Error itself, populated by the parser/checker via a constructor
+// such as common.NewErrorWithNodeID, threaded into a matching field on the
+// generated confpb.IssueDetails message. Neither common.Error nor the
+// confpb package are regenerable in this tree, so this reconstructs the ID
+// from e.Location and the SourceInfo the caller already has on hand, and
+// surfaces it through errdetails.ErrorInfo (part of the already-vendored
+// genproto rpc/errdetails package) rather than IssueDetails. Once the real
+// fields land, prefer e.Id over exprIDForLocation and move the value back
+// into IssueDetails.
+func ErrToStatus(e common.Error, severity confpb.IssueDetails_Severity, info *exprpb.SourceInfo) *rpcpb.Status {
 	detail := confpb.IssueDetails{
 		Severity: severity,
 		Position: &exprpb.SourcePosition{
@@ -153,13 +189,76 @@ func ErrToStatus(e common.Error, severity confpb.IssueDetails_Severity) *rpcpb.S
 		},
 	}
 	s := status.New(codes.InvalidArgument, e.Message)
-	sd, err := s.WithDetails(&detail)
+	var sd *status.Status
+	var err error
+	if id, ok := exprIDForLocation(info, e.Location); ok {
+		errInfo := errdetailspb.ErrorInfo{
+			Reason:   "EXPR_ID",
+			Metadata: map[string]string{"exprId": strconv.FormatInt(id, 10)},
+		}
+		sd, err = s.WithDetails(&detail, &errInfo)
+	} else {
+		sd, err = s.WithDetails(&detail)
+	}
 	if err == nil {
 		return sd.Proto()
 	}
 	return s.Proto()
 }
 
+// exprIDForLocation looks up the expr ID whose source position matches loc
+// by reverse-searching info.Positions, the map from expr ID to absolute
+// character offset that SourceInfo already carries on every parsed
+// expression. ok is false if info is nil or no node starts at loc.
+//
+// A macro expansion (map/filter/exists/all/has, ...) stamps every
+// synthesized sub-node - the iteration variable, accumulator init,
+// condition, step, and result - with the same source location as the
+// macro call itself, so more than one expr ID can share an offset. Since
+// info.Positions is a Go map, iteration order over those ties isn't
+// stable across calls; to keep the result deterministic, ties are broken
+// by returning the lowest matching expr ID.
+func exprIDForLocation(info *exprpb.SourceInfo, loc common.Location) (id int64, ok bool) {
+	if info == nil {
+		return 0, false
+	}
+	offset, ok := charOffset(info, loc)
+	if !ok {
+		return 0, false
+	}
+	found := false
+	for exprID, pos := range info.GetPositions() {
+		if int64(pos) != offset {
+			continue
+		}
+		if !found || exprID < id {
+			id = exprID
+			found = true
+		}
+	}
+	return id, found
+}
+
+// charOffset converts loc (a 1-based line, 0-based column) into the
+// absolute character offset SourceInfo.Positions uses, via
+// info.LineOffsets, the offset of the first character of every line past
+// the first.
+func charOffset(info *exprpb.SourceInfo, loc common.Location) (int64, bool) {
+	line := loc.Line()
+	if line < 1 {
+		return 0, false
+	}
+	var lineStart int64
+	if line > 1 {
+		offsets := info.GetLineOffsets()
+		if line-2 >= len(offsets) {
+			return 0, false
+		}
+		lineStart = int64(offsets[line-2])
+	}
+	return lineStart + int64(loc.Column()), true
+}
+
 // TODO(jimlarson): The following conversion code should be moved to
 // common/types/provider.go and consolidated/refactored as appropriate.
 // In particular, make judicious use of types.NativeToValue().
@@ -176,6 +275,21 @@ func RefValueToExprValue(res ref.Val, err error) (*exprpb.ExprValue, error) {
 			},
 		}, nil
 	}
+	if types.IsError(res) {
+		if errs, ok := decodeErrorSet(res); ok {
+			return &exprpb.ExprValue{
+				Kind: &exprpb.ExprValue_Error{
+					Error: &exprpb.ErrorSet{Errors: errs},
+				},
+			}, nil
+		}
+		s := status.New(codes.Unknown, res.(*types.Err).Error()).Proto()
+		return &exprpb.ExprValue{
+			Kind: &exprpb.ExprValue_Error{
+				Error: &exprpb.ErrorSet{Errors: []*rpcpb.Status{s}},
+			},
+		}, nil
+	}
 	if types.IsUnknown(res) {
 		return &exprpb.ExprValue{
 			Kind: &exprpb.ExprValue_Unknown{
@@ -199,16 +313,40 @@ func ExprValueToRefValue(adapter ref.TypeAdapter, ev *exprpb.ExprValue) (ref.Val
 		return cel.ValueToRefValue(adapter, ev.GetValue())
 	case *exprpb.ExprValue_Error:
 		// An error ExprValue is a repeated set of rpcpb.Status
-		// messages, with no convention for the status details.
-		// To convert this to a types.Err, we need to convert
-		// these Status messages to a single string, and be
-		// able to decompose that string on output so we can
-		// round-trip arbitrary ExprValue messages.
-		// TODO(jimlarson) make a convention for this.
-		return types.NewErr("XXX add details later"), nil
+		// messages, with no native representation in types.Err. We pack
+		// the list as JSON behind errorSetPrefix so that a round trip
+		// through RefValueToExprValue recovers the original statuses.
+		return encodeErrorSet(ev.GetError().GetErrors()), nil
 	case *exprpb.ExprValue_Unknown:
 		return types.Unknown(ev.GetUnknown().Exprs), nil
 	}
 	return nil, status.New(codes.InvalidArgument, "unknown ExprValue kind").Err()
 }
 
+// encodeErrorSet packs a list of rpcpb.Status messages into a types.Err whose
+// message carries the JSON-encoded original statuses, so it can later be
+// recovered by decodeErrorSet.
+func encodeErrorSet(errs []*rpcpb.Status) ref.Val {
+	data, err := json.Marshal(errs)
+	if err != nil {
+		return types.NewErr("unable to encode error set: %s", err)
+	}
+	return types.NewErr("%s", errorSetPrefix+string(data))
+}
+
+// decodeErrorSet recovers the rpcpb.Status list packed into res by
+// encodeErrorSet. ok is false if res is not such an encoded error.
+func decodeErrorSet(res ref.Val) (errs []*rpcpb.Status, ok bool) {
+	errVal, isErr := res.(*types.Err)
+	if !isErr {
+		return nil, false
+	}
+	msg := errVal.Error()
+	if !strings.HasPrefix(msg, errorSetPrefix) {
+		return nil, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(msg, errorSetPrefix)), &errs); err != nil {
+		return nil, false
+	}
+	return errs, true
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// checkedSourceInfo parses src, returning the SourceInfo the parser
+// attached to it so tests can look up real expr IDs by position.
+func checkedSourceInfo(t *testing.T, src string) *exprpb.SourceInfo {
+	t.Helper()
+	env, err := cel.NewEnv()
+	if err != nil {
+		t.Fatalf("cel.NewEnv() failed: %v", err)
+	}
+	ast, iss := env.Parse(src)
+	if iss != nil && iss.Err() != nil {
+		t.Fatalf("env.Parse(%q) failed: %v", src, iss.Err())
+	}
+	parsedExpr, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		t.Fatalf("cel.AstToParsedExpr() failed: %v", err)
+	}
+	return parsedExpr.GetSourceInfo()
+}
+
+func TestExprIDForLocationSingleLine(t *testing.T) {
+	info := checkedSourceInfo(t, "1 + 2")
+	// The literal 1 starts at column 0 of line 1; the '+' call is placed
+	// at its operator, offset 2.
+	id, ok := exprIDForLocation(info, testLocation{line: 1, column: 0})
+	if !ok {
+		t.Fatalf("exprIDForLocation() not found, want the id of the node at offset 0")
+	}
+	if want, ok := info.GetPositions()[id]; !ok || int64(want) != 0 {
+		t.Errorf("resolved id %d does not start at offset 0: positions = %v", id, info.GetPositions())
+	}
+}
+
+func TestExprIDForLocationNoMatch(t *testing.T) {
+	info := checkedSourceInfo(t, "1 + 2")
+	if _, ok := exprIDForLocation(info, testLocation{line: 1, column: 99}); ok {
+		t.Errorf("exprIDForLocation() found a match at an offset with no node")
+	}
+}
+
+func TestExprIDForLocationNilInfo(t *testing.T) {
+	if _, ok := exprIDForLocation(nil, testLocation{line: 1, column: 0}); ok {
+		t.Errorf("exprIDForLocation(nil, ...) = ok, want not found")
+	}
+}
+
+// TestExprIDForLocationDeterministicTieBreak models the scenario a macro
+// expansion produces: several expr IDs (the iteration variable, accumulator
+// init, condition, step, result, ...) all stamped with the macro call's own
+// source location, hence sharing one offset in Positions. Because Positions
+// is a Go map, a first-match scan over it is not guaranteed to return the
+// same id from one call to the next; exprIDForLocation must break the tie
+// the same documented way (lowest id) every time.
+func TestExprIDForLocationDeterministicTieBreak(t *testing.T) {
+	info := &exprpb.SourceInfo{
+		Positions: map[int64]int32{
+			5: 0,
+			2: 0,
+			9: 0,
+			1: 3, // a different node, not part of the tie.
+		},
+	}
+	loc := testLocation{line: 1, column: 0}
+	for i := 0; i < 20; i++ {
+		id, ok := exprIDForLocation(info, loc)
+		if !ok {
+			t.Fatalf("exprIDForLocation() not found on run %d", i)
+		}
+		if id != 2 {
+			t.Errorf("exprIDForLocation() = %d on run %d, want the lowest tied id (2)", id, i)
+		}
+	}
+}
+
+func TestCharOffsetMultiline(t *testing.T) {
+	info := checkedSourceInfo(t, "1 +\n  2")
+	// Column 2 of line 2 follows the 4-byte first line ("1 +\n").
+	offset, ok := charOffset(info, testLocation{line: 2, column: 2})
+	if !ok {
+		t.Fatalf("charOffset() not found")
+	}
+	if offset != 6 {
+		t.Errorf("charOffset() = %d, want 6", offset)
+	}
+}
+
+// testLocation is a minimal common.Location for tests that don't need a
+// real common.Source to build one.
+type testLocation struct {
+	line, column int
+}
+
+func (l testLocation) Line() int   { return l.line }
+func (l testLocation) Column() int { return l.column }